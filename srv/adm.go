@@ -19,6 +19,7 @@ package srv
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -32,19 +33,95 @@ import (
 	"time"
 )
 
+const (
+	defaultADMRequestTimeout = 10 * time.Second
+	defaultADMBatchDeadline  = 0 // no batch deadline unless configured
+	defaultADMMaxRetries     = 2
+	defaultADMBaseBackoff    = 500 * time.Millisecond
+)
+
 const (
 	admTokenURL   string = "https://api.amazon.com/auth/O2/token"
 	admServiceURL string = "https://api.amazon.com/messaging/registrations/"
 )
 
 type admPushService struct {
+	tokenMu    sync.Mutex
+	tokenCalls map[string]*tokenCall
+
+	// dataMu guards every read/write of a PushServiceProvider's
+	// VolatileData. Multiple delivery points for the same PSP are pushed
+	// from concurrent goroutines, any of which can invalidate or refresh
+	// the cached token, so that map can't be touched without a lock.
+	dataMu sync.Mutex
+
+	// tokenStore rehydrates VolatileData on startup and persists every
+	// successful refresh, so a restart doesn't force every configured PSP
+	// to re-authenticate against admTokenURL at once. Defaults to an
+	// in-memory store; set token_cache_dir on a PSP to persist to disk.
+	tokenStore TokenStore
+
+	// tokenStoreMu guards tokenStores, the per-clientid overrides of
+	// tokenStore set via token_cache_dir.
+	tokenStoreMu sync.Mutex
+	tokenStores  map[string]TokenStore
+
+	// metrics records push activity under the shared uniqush_adm_* metric
+	// families. Defaults to the process-wide Prometheus collector.
+	metrics MetricsCollector
+
+	// errChan is where out-of-band failures too minor to fail a push (e.g.
+	// a token that could not be persisted to disk) are reported, set via SetErrorReportChan.
+	// Nil until the caller sets one, in which case those failures are
+	// dropped rather than logged to stdout.
+	errChanMu sync.Mutex
+	errChan   chan<- error
+}
+
+// tokenCall represents a single in-flight token refresh for one PSP. Any
+// Push() goroutines that arrive while it is running block on wg and then
+// share its result instead of firing their own request to admTokenURL.
+type tokenCall struct {
+	wg  sync.WaitGroup
+	err error
 }
 
 func newADMPushService() *admPushService {
 	ret := new(admPushService)
+	ret.tokenCalls = make(map[string]*tokenCall)
+	ret.tokenStore = NewMemTokenStore()
+	ret.tokenStores = make(map[string]TokenStore)
+	ret.metrics = defaultMetrics
 	return ret
 }
 
+// storeFor returns the TokenStore a given clientid should persist through:
+// its own token_cache_dir override if BuildPushServiceProviderFromMap set
+// one, otherwise the service-wide default.
+func (self *admPushService) storeFor(clientid string) TokenStore {
+	self.tokenStoreMu.Lock()
+	defer self.tokenStoreMu.Unlock()
+	if s, ok := self.tokenStores[clientid]; ok {
+		return s
+	}
+	return self.tokenStore
+}
+
+// SetDeadline bounds how long an entire Push() batch against psp may run,
+// the same way net.Conn.SetDeadline bounds outstanding I/O: once d elapses,
+// ctx is cancelled and every in-flight client.Do sharing it aborts.
+func (self *admPushService) SetDeadline(psp *PushServiceProvider, parent context.Context) (context.Context, context.CancelFunc) {
+	d := pspBatchDeadline(psp)
+	if d <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, d)
+}
+
+func pspTokenKey(psp *PushServiceProvider) string {
+	return psp.FixedData["clientid"]
+}
+
 func InstallADM() {
 	psm := GetPushServiceManager()
 	psm.RegisterPushServiceType(newADMPushService())
@@ -55,7 +132,25 @@ func (self *admPushService) Name() string {
 	return "adm"
 }
 func (self *admPushService) SetErrorReportChan(errChan chan<- error) {
-	return
+	self.errChanMu.Lock()
+	defer self.errChanMu.Unlock()
+	self.errChan = errChan
+}
+
+// reportError sends err to the channel set by SetErrorReportChan, if any,
+// without blocking if nobody is reading it. Used for failures that
+// shouldn't interrupt the push in progress but are still worth surfacing.
+func (self *admPushService) reportError(err error) {
+	self.errChanMu.Lock()
+	ch := self.errChan
+	self.errChanMu.Unlock()
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- err:
+	default:
+	}
 }
 
 func (self *admPushService) BuildPushServiceProviderFromMap(kv map[string]string, psp *PushServiceProvider) error {
@@ -77,9 +172,133 @@ func (self *admPushService) BuildPushServiceProviderFromMap(kv map[string]string
 		return errors.New("NoClientSecrete")
 	}
 
+	if timeout, ok := kv["request_timeout_ms"]; ok && len(timeout) > 0 {
+		if _, err := strconv.ParseInt(timeout, 10, 64); err != nil {
+			return fmt.Errorf("bad request_timeout_ms: %v", err)
+		}
+		psp.FixedData["request_timeout_ms"] = timeout
+	}
+
+	if deadline, ok := kv["batch_deadline_ms"]; ok && len(deadline) > 0 {
+		if _, err := strconv.ParseInt(deadline, 10, 64); err != nil {
+			return fmt.Errorf("bad batch_deadline_ms: %v", err)
+		}
+		psp.FixedData["batch_deadline_ms"] = deadline
+	}
+
+	if dir, ok := kv["token_cache_dir"]; ok && len(dir) > 0 {
+		self.tokenStoreMu.Lock()
+		self.tokenStores[psp.FixedData["clientid"]] = NewFileTokenStore(dir)
+		self.tokenStoreMu.Unlock()
+	}
+
+	if retries, ok := kv["max_retries"]; ok && len(retries) > 0 {
+		if _, err := strconv.Atoi(retries); err != nil {
+			return fmt.Errorf("bad max_retries: %v", err)
+		}
+		psp.FixedData["max_retries"] = retries
+	}
+
+	if backoff, ok := kv["base_backoff_ms"]; ok && len(backoff) > 0 {
+		if _, err := strconv.ParseInt(backoff, 10, 64); err != nil {
+			return fmt.Errorf("bad base_backoff_ms: %v", err)
+		}
+		psp.FixedData["base_backoff_ms"] = backoff
+	}
+
+	self.rehydrateToken(psp)
+
 	return nil
 }
 
+// rehydrateToken loads a cached token from tokenStore into psp.VolatileData
+// if it's still unexpired, so a fresh process doesn't have to hit
+// admTokenURL before it can serve its first Push.
+func (self *admPushService) rehydrateToken(psp *PushServiceProvider) {
+	clientid, ok := psp.FixedData["clientid"]
+	if !ok {
+		return
+	}
+	tok, err := self.storeFor(clientid).Load(clientid)
+	if err != nil || tok == nil {
+		return
+	}
+	if !time.Unix(tok.ExpiresAt, 0).After(time.Now()) {
+		return
+	}
+	self.dataMu.Lock()
+	psp.VolatileData["token"] = tok.Token
+	psp.VolatileData["expire"] = fmt.Sprintf("%v", tok.ExpiresAt)
+	psp.VolatileData["type"] = tok.TokenType
+	self.dataMu.Unlock()
+}
+
+// invalidateToken drops the cached token so the next refreshToken call is
+// forced to hit admTokenURL again, e.g. after ADM reports it as expired.
+func (self *admPushService) invalidateToken(psp *PushServiceProvider) {
+	self.dataMu.Lock()
+	delete(psp.VolatileData, "token")
+	delete(psp.VolatileData, "expire")
+	self.dataMu.Unlock()
+}
+
+// pspRequestTimeout returns the configured per-request timeout for psp, or
+// defaultADMRequestTimeout if it wasn't set (or was set to something we
+// can no longer parse).
+func pspRequestTimeout(psp *PushServiceProvider) time.Duration {
+	ms, ok := psp.FixedData["request_timeout_ms"]
+	if !ok {
+		return defaultADMRequestTimeout
+	}
+	v, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil || v <= 0 {
+		return defaultADMRequestTimeout
+	}
+	return time.Duration(v) * time.Millisecond
+}
+
+// pspBatchDeadline returns the configured deadline for an entire Push() call
+// against psp, or defaultADMBatchDeadline (no deadline) if it wasn't set.
+func pspBatchDeadline(psp *PushServiceProvider) time.Duration {
+	ms, ok := psp.FixedData["batch_deadline_ms"]
+	if !ok {
+		return defaultADMBatchDeadline
+	}
+	v, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil || v <= 0 {
+		return defaultADMBatchDeadline
+	}
+	return time.Duration(v) * time.Millisecond
+}
+
+// pspMaxRetries returns how many times admSinglePush should retry a failed
+// delivery beyond the first attempt, or defaultADMMaxRetries if unset.
+func pspMaxRetries(psp *PushServiceProvider) int {
+	s, ok := psp.FixedData["max_retries"]
+	if !ok {
+		return defaultADMMaxRetries
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 {
+		return defaultADMMaxRetries
+	}
+	return v
+}
+
+// pspBaseBackoff returns the starting delay for the exponential backoff used
+// between retries, or defaultADMBaseBackoff if unset.
+func pspBaseBackoff(psp *PushServiceProvider) time.Duration {
+	ms, ok := psp.FixedData["base_backoff_ms"]
+	if !ok {
+		return defaultADMBaseBackoff
+	}
+	v, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil || v <= 0 {
+		return defaultADMBaseBackoff
+	}
+	return time.Duration(v) * time.Millisecond
+}
+
 func (self *admPushService) BuildDeliveryPointFromMap(kv map[string]string, dp *DeliveryPoint) error {
 	if service, ok := kv["service"]; ok && len(service) > 0 {
 		dp.FixedData["service"] = service
@@ -112,21 +331,59 @@ type tokenFailObj struct {
 	Description string `json:"error_description"`
 }
 
-// FIXME concurrency bug: lock the token for each psp.
-func requestToken(psp *PushServiceProvider) error {
+// refreshToken makes sure at most one goroutine per PSP is ever talking to
+// admTokenURL at a time. Callers that arrive while a refresh is already
+// in-flight block on it and reuse its outcome instead of racing to request
+// their own token. Only the goroutine that actually performed the refresh
+// gets back the *PushServiceProviderUpdate so callers don't report the same
+// update to resQueue more than once per real refresh.
+func (self *admPushService) refreshToken(ctx context.Context, psp *PushServiceProvider) error {
+	key := pspTokenKey(psp)
+
+	self.tokenMu.Lock()
+	if call, ok := self.tokenCalls[key]; ok {
+		self.tokenMu.Unlock()
+		call.wg.Wait()
+		if _, isUpdate := call.err.(*PushServiceProviderUpdate); isUpdate {
+			return nil
+		}
+		return call.err
+	}
+
+	call := &tokenCall{}
+	call.wg.Add(1)
+	self.tokenCalls[key] = call
+	self.tokenMu.Unlock()
+
+	call.err = self.requestToken(ctx, psp)
+
+	self.tokenMu.Lock()
+	delete(self.tokenCalls, key)
+	self.tokenMu.Unlock()
+	call.wg.Done()
+
+	return call.err
+}
+
+// requestToken returns nil right away if psp already holds an unexpired
+// token; otherwise it talks to admTokenURL and stores the result on psp.
+// Callers wanting the per-PSP locking and request coalescing should go
+// through refreshToken instead of calling this directly.
+func (self *admPushService) requestToken(ctx context.Context, psp *PushServiceProvider) (err error) {
 	var ok bool
 	var clientid string
 	var cserect string
 
-	if _, ok = psp.VolatileData["token"]; ok {
-		if exp, ok := psp.VolatileData["expire"]; ok {
-			unixsec, err := strconv.ParseInt(exp, 10, 64)
-			if err == nil {
-				deadline := time.Unix(unixsec, int64(0))
-				if deadline.After(time.Now()) {
-					fmt.Printf("We don't need to request another token\n")
-					return nil
-				}
+	self.dataMu.Lock()
+	_, hasToken := psp.VolatileData["token"]
+	expireVal, hasExpire := psp.VolatileData["expire"]
+	self.dataMu.Unlock()
+	if hasToken && hasExpire {
+		unixsec, err := strconv.ParseInt(expireVal, 10, 64)
+		if err == nil {
+			deadline := time.Unix(unixsec, int64(0))
+			if deadline.After(time.Now()) {
+				return nil
 			}
 		}
 	}
@@ -137,12 +394,23 @@ func requestToken(psp *PushServiceProvider) error {
 	if cserect, ok = psp.FixedData["clientsecret"]; !ok {
 		return NewBadPushServiceProviderWithDetails(psp, "NoClientSecrete")
 	}
+
+	defer func() {
+		result := "success"
+		if _, isUpdate := err.(*PushServiceProviderUpdate); err != nil && !isUpdate {
+			result = "failure"
+		}
+		self.metrics.ObserveTokenRequest(admServiceLabel, result)
+	}()
+
 	form := url.Values{}
 	form.Set("grant_type", "client_credentials")
 	form.Set("scope", "messaging:push")
 	form.Set("client_id", clientid)
 	form.Set("client_secret", cserect)
-	req, err := http.NewRequest("POST", admTokenURL, bytes.NewBufferString(form.Encode()))
+	reqCtx, cancel := context.WithTimeout(ctx, pspRequestTimeout(psp))
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, "POST", admTokenURL, bytes.NewBufferString(form.Encode()))
 	if err != nil {
 		return fmt.Errorf("NewRequest error: %v", err)
 	}
@@ -150,7 +418,9 @@ func requestToken(psp *PushServiceProvider) error {
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
 	client := &http.Client{}
+	self.metrics.IncInflight(admServiceLabel)
 	resp, err := client.Do(req)
+	self.metrics.DecInflight(admServiceLabel)
 	if err != nil {
 		return fmt.Errorf("Do error: %v", err)
 	}
@@ -182,13 +452,23 @@ func requestToken(psp *PushServiceProvider) error {
 		return NewBadPushServiceProviderWithDetails(psp, err.Error())
 	}
 
-	fmt.Printf("Obtained the token: %+v\n", succ)
-
 	expire := time.Now().Add(time.Duration(succ.Expire-60) * time.Second)
 
+	self.dataMu.Lock()
 	psp.VolatileData["expire"] = fmt.Sprintf("%v", expire.Unix())
 	psp.VolatileData["token"] = succ.Token
 	psp.VolatileData["type"] = succ.Type
+	self.dataMu.Unlock()
+
+	if err := self.storeFor(clientid).Save(clientid, &StoredToken{
+		Token:     succ.Token,
+		ExpiresAt: expire.Unix(),
+		TokenType: succ.Type,
+	}); err != nil {
+		self.reportError(fmt.Errorf("adm: failed to persist token for %v: %v", clientid, err))
+	}
+	self.metrics.SetTokenExpiry(admServiceLabel, clientid, expire.Unix())
+
 	return NewPushServiceProviderUpdate(psp)
 }
 
@@ -241,10 +521,11 @@ func admURL(dp *DeliveryPoint) (url string, err error) {
 	return
 }
 
-func admNewRequest(psp *PushServiceProvider, dp *DeliveryPoint, data []byte) (req *http.Request, err error) {
-	var token string
-	var ok bool
-	if token, ok = psp.VolatileData["token"]; !ok {
+func (self *admPushService) admNewRequest(ctx context.Context, psp *PushServiceProvider, dp *DeliveryPoint, data []byte) (req *http.Request, err error) {
+	self.dataMu.Lock()
+	token, ok := psp.VolatileData["token"]
+	self.dataMu.Unlock()
+	if !ok {
 		err = NewBadPushServiceProviderWithDetails(psp, "NoToken")
 		return
 	}
@@ -253,7 +534,7 @@ func admNewRequest(psp *PushServiceProvider, dp *DeliveryPoint, data []byte) (re
 		return
 	}
 
-	req, err = http.NewRequest("POST", url, bytes.NewBuffer(data))
+	req, err = http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
 	if err != nil {
 		return
 	}
@@ -267,39 +548,140 @@ func admNewRequest(psp *PushServiceProvider, dp *DeliveryPoint, data []byte) (re
 	return
 }
 
-func admSinglePush(psp *PushServiceProvider, dp *DeliveryPoint, data []byte) (string, error) {
+// ErrADMTimeout marks a delivery that was aborted because its per-request or
+// per-batch deadline expired, so callers can tell it apart from a failure
+// ADM itself reported.
+type ErrADMTimeout struct {
+	Destination *DeliveryPoint
+	Cause       error
+}
+
+func (e *ErrADMTimeout) Error() string {
+	return fmt.Sprintf("adm push to %v timed out: %v", e.Destination, e.Cause)
+}
+
+func (self *admPushService) admSendOnce(ctx context.Context, psp *PushServiceProvider, dp *DeliveryPoint, data []byte) (id string, status int, body []byte, retryAfter string, err error) {
 	client := &http.Client{}
-	req, err := admNewRequest(psp, dp, data)
+	reqCtx, cancel := context.WithTimeout(ctx, pspRequestTimeout(psp))
+	defer cancel()
+	req, err := self.admNewRequest(reqCtx, psp, dp, data)
 	if err != nil {
-		return "", err
+		return
 	}
 	defer req.Body.Close()
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return
 	}
 	defer resp.Body.Close()
 
-	id := resp.Header.Get("x-amzn-RequestId")
-	if resp.StatusCode != 200 {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return "", err
+	id = resp.Header.Get("x-amzn-RequestId")
+	status = resp.StatusCode
+	retryAfter = resp.Header.Get("Retry-After")
+	body, err = ioutil.ReadAll(resp.Body)
+	return
+}
+
+// admSinglePush performs a single ADM delivery, retrying on the classified
+// errors from parseADMError: an expired token is refreshed once (coordinated
+// through refreshToken so concurrent DPs share the refresh) before retrying,
+// MaxRateExceeded/5xx/network errors back off per Retry-After or a bounded
+// exponential backoff, and an unregistered regid is reported immediately
+// without burning retries on it. If this call is the one that actually
+// performs a mid-push token refresh, it reports the resulting
+// PushServiceProviderUpdate on resQueue itself, since its own return value
+// is reserved for the push outcome.
+func (self *admPushService) admSinglePush(ctx context.Context, psp *PushServiceProvider, dp *DeliveryPoint, notif *Notification, data []byte, resQueue chan<- *PushResult) (string, error) {
+	start := time.Now()
+	var lastPushErr error
+	defer func() {
+		self.metrics.ObservePush(admServiceLabel, classifyPushResult(lastPushErr), time.Since(start))
+	}()
+
+	maxRetries := pspMaxRetries(psp)
+	baseBackoff := pspBaseBackoff(psp)
+
+	var lastErr error
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		self.metrics.IncInflight(admServiceLabel)
+		sentID, status, body, retryAfter, sendErr := self.admSendOnce(ctx, psp, dp, data)
+		self.metrics.DecInflight(admServiceLabel)
+
+		if sendErr != nil {
+			if ctx.Err() != nil {
+				lastPushErr = &ErrADMTimeout{Destination: dp, Cause: sendErr}
+				return "", lastPushErr
+			}
+			lastErr = &ErrRetryAfter{Cause: sendErr}
+		} else if status == 200 {
+			return sentID, nil
+		} else {
+			lastErr = parseADMError(status, body, retryAfter)
+		}
+
+		if attempt >= maxRetries {
+			break
 		}
-		err = fmt.Errorf("%v: %v", resp.StatusCode, string(body))
-		return "", err
+		wait, retryable := retryDelay(lastErr, baseBackoff, attempt)
+		if !retryable {
+			break
+		}
+
+		if _, ok := lastErr.(*ErrInvalidToken); ok {
+			if refreshed {
+				break
+			}
+			refreshed = true
+			self.invalidateToken(psp)
+			if rerr := self.refreshToken(ctx, psp); rerr != nil {
+				if _, isUpdate := rerr.(*PushServiceProviderUpdate); isUpdate {
+					updateRes := new(PushResult)
+					updateRes.Content = notif
+					updateRes.Provider = psp
+					updateRes.Destination = dp
+					updateRes.Err = rerr
+					resQueue <- updateRes
+				} else {
+					lastPushErr = rerr
+					return "", lastPushErr
+				}
+			}
+			continue
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			lastPushErr = &ErrADMTimeout{Destination: dp, Cause: ctx.Err()}
+			return "", lastPushErr
+		}
+	}
+
+	if ra, ok := lastErr.(*ErrRetryAfter); ok && errors.Is(ra.Cause, context.DeadlineExceeded) {
+		lastErr = &ErrADMTimeout{Destination: dp, Cause: ra.Cause}
 	}
-	return id, nil
+	lastPushErr = lastErr
+	if _, ok := lastErr.(*ErrUnregistered); ok {
+		return "", NewBadDeliveryPointWithDetails(dp, "adm: unregistered")
+	}
+	return "", lastErr
 }
 
-func (self *admPushService) Push(psp *PushServiceProvider, dpQueue <-chan *DeliveryPoint, resQueue chan<- *PushResult, notif *Notification) {
+// Push implements the PushService interface. Cancelling ctx aborts the whole
+// batch; SetDeadline derives from it a context that additionally expires
+// after psp's batch_deadline_ms, and every request below inherits that.
+func (self *admPushService) Push(ctx context.Context, psp *PushServiceProvider, dpQueue <-chan *DeliveryPoint, resQueue chan<- *PushResult, notif *Notification) {
 	defer close(resQueue)
 	defer func() {
 		for _ = range dpQueue {
 		}
 	}()
 
-	err := requestToken(psp)
+	ctx, cancel := self.SetDeadline(psp, ctx)
+	defer cancel()
+
+	err := self.refreshToken(ctx, psp)
 	res := new(PushResult)
 	res.Content = notif
 	res.Provider = psp
@@ -334,10 +716,10 @@ func (self *admPushService) Push(psp *PushServiceProvider, dpQueue <-chan *Deliv
 		res.Provider = psp
 		res.Destination = dp
 		go func() {
-			res.MsgId, res.Err = admSinglePush(psp, dp, data)
+			res.MsgId, res.Err = self.admSinglePush(ctx, psp, dp, notif, data, resQueue)
 			resQueue <- res
 			wg.Done()
 		}()
 	}
 	wg.Wait()
-}
\ No newline at end of file
+}
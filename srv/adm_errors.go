@@ -0,0 +1,144 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUnregistered means ADM reports the delivery point's registration ID as
+// no longer valid. It is not retryable; admSinglePush converts it into a
+// BadDeliveryPoint error instead of returning it directly, so callers treat
+// it the same way they already treat any other invalid delivery point.
+type ErrUnregistered struct{}
+
+func (e *ErrUnregistered) Error() string {
+	return "adm: delivery point is unregistered"
+}
+
+// ErrInvalidToken means ADM rejected the bearer token used for the request,
+// either because it expired or because ADM itself doesn't recognize it.
+type ErrInvalidToken struct {
+	Reason string
+}
+
+func (e *ErrInvalidToken) Error() string {
+	return fmt.Sprintf("adm: invalid access token (%v)", e.Reason)
+}
+
+// ErrRateLimited means ADM's MaxRateExceeded error fired for this PSP.
+type ErrRateLimited struct {
+	RetryAfter time.Duration
+}
+
+func (e *ErrRateLimited) Error() string {
+	return fmt.Sprintf("adm: rate limited, retry after %v", e.RetryAfter)
+}
+
+// ErrRetryAfter covers everything else worth retrying: ADM 5xx responses and
+// network-level failures talking to admServiceURL.
+type ErrRetryAfter struct {
+	RetryAfter time.Duration
+	Cause      error
+}
+
+func (e *ErrRetryAfter) Error() string {
+	return fmt.Sprintf("adm: transient failure, retry after %v: %v", e.RetryAfter, e.Cause)
+}
+
+type admErrorObj struct {
+	Reason string `json:"reason"`
+}
+
+// parseADMError classifies a non-200 ADM response into one of the typed
+// errors above so admSinglePush's retry loop can decide what to do with it,
+// instead of collapsing everything into one opaque string.
+func parseADMError(status int, body []byte, retryAfterHeader string) error {
+	var obj admErrorObj
+	json.Unmarshal(body, &obj)
+	reason := strings.ToUpper(obj.Reason)
+	retryAfter, hasRetryAfter := parseRetryAfter(retryAfterHeader)
+
+	switch {
+	case reason == "UNREGISTERED" || reason == "INVALIDREGISTRATIONID":
+		return &ErrUnregistered{}
+	case status == 401 || reason == "ACCESSTOKENEXPIRED" || reason == "INVALIDAUTHTOKEN" || reason == "INVALID_SCOPE":
+		return &ErrInvalidToken{Reason: obj.Reason}
+	case status == 429 || reason == "MAXRATEEXCEEDED":
+		if !hasRetryAfter {
+			retryAfter = time.Second
+		}
+		return &ErrRateLimited{RetryAfter: retryAfter}
+	case status >= 500:
+		return &ErrRetryAfter{RetryAfter: retryAfter, Cause: fmt.Errorf("%v: %v", status, obj.Reason)}
+	default:
+		return fmt.Errorf("%v: %v", status, string(body))
+	}
+}
+
+// parseRetryAfter only understands the delta-seconds form of Retry-After,
+// which is what ADM sends; the HTTP-date form isn't worth the complexity
+// here.
+func parseRetryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	secs, err := strconv.Atoi(header)
+	if err != nil || secs < 0 {
+		return 0, false
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+// backoffWait returns the wait for retry attempt n (0-based) given a base
+// delay: the delay doubles each attempt, and a random wait between half of
+// it and all of it is picked so a burst of concurrent retries doesn't all
+// land on ADM at once.
+func backoffWait(base time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	d := base << uint(attempt)
+	jitter := time.Duration(rand.Int63n(int64(d)/2 + 1))
+	return d/2 + jitter
+}
+
+// retryDelay decides whether err is worth retrying and, if so, how long to
+// wait first.
+func retryDelay(err error, base time.Duration, attempt int) (time.Duration, bool) {
+	switch e := err.(type) {
+	case *ErrUnregistered:
+		return 0, false
+	case *ErrInvalidToken:
+		return 0, true
+	case *ErrRateLimited:
+		return e.RetryAfter, true
+	case *ErrRetryAfter:
+		if e.RetryAfter > 0 {
+			return e.RetryAfter, true
+		}
+		return backoffWait(base, attempt), true
+	default:
+		return 0, false
+	}
+}
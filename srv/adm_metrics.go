@@ -0,0 +1,152 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// admServiceLabel is the "service" label value adm reports itself under, so
+// GCM/APNS can register the same metric families alongside it without
+// colliding.
+const admServiceLabel = "adm"
+
+// MetricsCollector is the hook other push services are meant to register
+// against so push activity across ADM, GCM, APNS etc. shares one set of
+// metric families instead of each service inventing its own. Every method
+// takes the calling service's label explicitly and none takes a per-regid
+// identifier; only SetTokenExpiry takes a per-PSP clientid, so cardinality
+// grows with the number of configured PSPs but not with delivery points.
+//
+// For now this interface and admPushService's use of it are private to srv;
+// it isn't yet surfaced on push.PushServiceManager, so gcm/apns can't reach
+// it. That's a cross-package change (PushServiceManager lives outside this
+// tree) left for a follow-up request rather than guessed at here.
+type MetricsCollector interface {
+	ObserveTokenRequest(service, result string)
+	ObservePush(service, result string, latency time.Duration)
+	SetTokenExpiry(service, clientid string, unixSeconds int64)
+	IncInflight(service string)
+	DecInflight(service string)
+}
+
+// promMetrics is the Prometheus-backed MetricsCollector registered by
+// default. It's a package-level singleton because prometheus collectors
+// must only be registered once per process.
+type promMetrics struct {
+	tokenRequests *prometheus.CounterVec
+	pushTotal     *prometheus.CounterVec
+	pushLatency   *prometheus.HistogramVec
+	tokenExpiry   *prometheus.GaugeVec
+	inflight      *prometheus.GaugeVec
+}
+
+// newPromMetrics registers the ADM metric families into reg. Production
+// code should use newDefaultPromMetrics, which registers into the global
+// default registry exactly once at package init; tests should pass their
+// own prometheus.NewRegistry() so repeated calls don't collide with the
+// package-wide registration.
+func newPromMetrics(reg prometheus.Registerer) *promMetrics {
+	m := &promMetrics{
+		tokenRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "uniqush_adm_token_requests_total",
+			Help: "Count of push-provider OAuth token requests by result.",
+		}, []string{"service", "result"}),
+		pushTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "uniqush_adm_push_total",
+			Help: "Count of push attempts by result.",
+		}, []string{"service", "result"}),
+		pushLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "uniqush_adm_push_latency_seconds",
+			Help:    "Latency of push attempts by outcome.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"service", "result"}),
+		tokenExpiry: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "uniqush_adm_token_expiry_seconds",
+			Help: "Unix time at which a PSP's cached OAuth token expires.",
+		}, []string{"service", "clientid"}),
+		inflight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "uniqush_adm_inflight_requests",
+			Help: "Number of outbound HTTP requests currently in flight.",
+		}, []string{"service"}),
+	}
+	reg.MustRegister(m.tokenRequests, m.pushTotal, m.pushLatency, m.tokenExpiry, m.inflight)
+	return m
+}
+
+// newDefaultPromMetrics registers into the process-wide default registry.
+// It must only be called once per process, which is why defaultMetrics
+// below is the only caller.
+func newDefaultPromMetrics() *promMetrics {
+	return newPromMetrics(prometheus.DefaultRegisterer)
+}
+
+func (m *promMetrics) ObserveTokenRequest(service, result string) {
+	m.tokenRequests.WithLabelValues(service, result).Inc()
+}
+
+func (m *promMetrics) ObservePush(service, result string, latency time.Duration) {
+	m.pushTotal.WithLabelValues(service, result).Inc()
+	m.pushLatency.WithLabelValues(service, result).Observe(latency.Seconds())
+}
+
+func (m *promMetrics) SetTokenExpiry(service, clientid string, unixSeconds int64) {
+	m.tokenExpiry.WithLabelValues(service, clientid).Set(float64(unixSeconds))
+}
+
+func (m *promMetrics) IncInflight(service string) {
+	m.inflight.WithLabelValues(service).Inc()
+}
+
+func (m *promMetrics) DecInflight(service string) {
+	m.inflight.WithLabelValues(service).Dec()
+}
+
+var defaultMetrics = newDefaultPromMetrics()
+
+// MetricsHandler returns the http.Handler the main binary should mount at
+// /metrics.
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// classifyPushResult turns an admSinglePush error into the bounded-
+// cardinality "result" label used by pushTotal/pushLatency.
+func classifyPushResult(err error) string {
+	if err == nil {
+		return "success"
+	}
+	switch err.(type) {
+	case *ErrADMTimeout:
+		return "timeout"
+	case *ErrUnregistered:
+		return "unregistered"
+	case *ErrInvalidToken:
+		return "invalid_token"
+	case *ErrRateLimited:
+		return "rate_limited"
+	case *ErrRetryAfter:
+		return "retry_after"
+	default:
+		return "error"
+	}
+}
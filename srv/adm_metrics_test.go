@@ -0,0 +1,94 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPromMetricsLabelCardinality(t *testing.T) {
+	m := newPromMetrics(prometheus.NewRegistry())
+
+	clientids := []string{"client-a", "client-b", "client-c"}
+	for i, id := range clientids {
+		m.ObserveTokenRequest(admServiceLabel, "success")
+		m.SetTokenExpiry(admServiceLabel, id, time.Now().Unix())
+		m.IncInflight(admServiceLabel)
+		// Simulate one push per regid under this clientid: cardinality on
+		// pushTotal/pushLatency/inflight must stay flat as regid count
+		// grows, since none of them carry a per-regid (or even per-dp)
+		// label -- only tokenExpiry is allowed to grow, and only with the
+		// clientid count, not the regid count.
+		for regid := 0; regid < i+1; regid++ {
+			m.ObservePush(admServiceLabel, "success", 10*time.Millisecond)
+			m.ObservePush(admServiceLabel, "unregistered", 5*time.Millisecond)
+		}
+		m.DecInflight(admServiceLabel)
+	}
+
+	// tokenRequests and pushTotal are only labeled by service+result, so no
+	// matter how many clientids/regids we observed, cardinality stays at
+	// one series per result.
+	if got := testutil.CollectAndCount(m.tokenRequests); got != 1 {
+		t.Errorf("tokenRequests has %d series, want 1 (no per-clientid label)", got)
+	}
+	if got := testutil.CollectAndCount(m.pushTotal); got != 2 {
+		t.Errorf("pushTotal has %d series, want 2 (one per result)", got)
+	}
+
+	// pushLatency carries the same labels as pushTotal, so it's exposed to
+	// the same per-regid blowup risk if a label were ever added there by
+	// mistake.
+	if got := testutil.CollectAndCount(m.pushLatency); got != 2 {
+		t.Errorf("pushLatency has %d series, want 2 (one per result, no per-regid label)", got)
+	}
+
+	// inflight is labeled by service only.
+	if got := testutil.CollectAndCount(m.inflight); got != 1 {
+		t.Errorf("inflight has %d series, want 1 (no per-clientid or per-regid label)", got)
+	}
+
+	// tokenExpiry is labeled by clientid by design, so it does grow with the
+	// number of configured PSPs -- just not with the number of regids.
+	if got := testutil.CollectAndCount(m.tokenExpiry); got != len(clientids) {
+		t.Errorf("tokenExpiry has %d series, want %d (one per clientid)", got, len(clientids))
+	}
+}
+
+func TestClassifyPushResult(t *testing.T) {
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{nil, "success"},
+		{&ErrADMTimeout{}, "timeout"},
+		{&ErrUnregistered{}, "unregistered"},
+		{&ErrInvalidToken{}, "invalid_token"},
+		{&ErrRateLimited{}, "rate_limited"},
+		{&ErrRetryAfter{}, "retry_after"},
+	}
+	for _, c := range cases {
+		if got := classifyPushResult(c.err); got != c.want {
+			t.Errorf("classifyPushResult(%v) = %q, want %q", c.err, got, c.want)
+		}
+	}
+}
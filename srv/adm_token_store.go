@@ -0,0 +1,156 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// StoredToken is what a TokenStore persists for one clientid.
+type StoredToken struct {
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expires_at"`
+	TokenType string `json:"token_type"`
+}
+
+// TokenStore persists OAuth tokens across process restarts, keyed by
+// clientid, so rebooting uniqush-push doesn't force every configured PSP to
+// re-authenticate against admTokenURL at once.
+//
+// This lives entirely inside srv for now rather than as a hook on
+// push.PushServiceManager, so GCM/FCM/APNS JWT can't share it yet. Exposing
+// it at the manager level is a cross-package change (push.PushServiceManager
+// is defined outside this tree) deliberately left for a follow-up request
+// rather than bolted on here as an unreviewed, untested guess at that
+// package's shape.
+type TokenStore interface {
+	Load(clientid string) (*StoredToken, error)
+	Save(clientid string, tok *StoredToken) error
+	Delete(clientid string) error
+}
+
+// MemTokenStore is a TokenStore that only lives in memory. It's the default
+// so the service works without any on-disk configuration, and it's what
+// tests should use instead of touching the filesystem.
+type MemTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]*StoredToken
+}
+
+func NewMemTokenStore() *MemTokenStore {
+	return &MemTokenStore{tokens: make(map[string]*StoredToken)}
+}
+
+func (s *MemTokenStore) Load(clientid string) (*StoredToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tok, ok := s.tokens[clientid]
+	if !ok {
+		return nil, nil
+	}
+	cp := *tok
+	return &cp, nil
+}
+
+func (s *MemTokenStore) Save(clientid string, tok *StoredToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp := *tok
+	s.tokens[clientid] = &cp
+	return nil
+}
+
+func (s *MemTokenStore) Delete(clientid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, clientid)
+	return nil
+}
+
+// FileTokenStore persists one JSON file per clientid under Dir. Saves are
+// atomic (write to a temp file, then rename) so a crash mid-write can never
+// leave a corrupt cache behind, and files are written 0600 since they hold
+// bearer tokens.
+type FileTokenStore struct {
+	Dir string
+}
+
+func NewFileTokenStore(dir string) *FileTokenStore {
+	return &FileTokenStore{Dir: dir}
+}
+
+func (s *FileTokenStore) path(clientid string) string {
+	return filepath.Join(s.Dir, fmt.Sprintf("adm-token-%s.json", clientid))
+}
+
+func (s *FileTokenStore) Load(clientid string) (*StoredToken, error) {
+	content, err := ioutil.ReadFile(s.path(clientid))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tok StoredToken
+	if err := json.Unmarshal(content, &tok); err != nil {
+		return nil, err
+	}
+	return &tok, nil
+}
+
+func (s *FileTokenStore) Save(clientid string, tok *StoredToken) error {
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	content, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(s.Dir, "adm-token-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0600); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, s.path(clientid))
+}
+
+func (s *FileTokenStore) Delete(clientid string) error {
+	err := os.Remove(s.path(clientid))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}